@@ -0,0 +1,121 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) since 2022, mzz2017 (mzz@tuta.io). All rights reserved.
+ */
+
+package control
+
+import (
+	"fmt"
+	"foo/common/consts"
+	"foo/component/outbound"
+	"foo/component/outbound/dialer"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// CheckConfig describes the periodic health probe run for a group (see
+// ControlPlane.startHealthChecks). Its results are only reported by the
+// diagnostic server; they are not passed to outbound.DialerGroup and do not
+// affect which dialer a DialerSelectionPolicy picks.
+type CheckConfig struct {
+	Url      string        `yaml:"url"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// GroupConfig describes a single named outbound group: the dialer URLs of
+// its member nodes (socks5://, ss://, ssr://, vmess://, vless://,
+// trojan://, http(s)://, ...), how a dialer is picked from the group for a
+// given connection, and how the group as a whole is health-checked.
+//
+// Policy is a name, not consts.DialerSelectionPolicy_E directly: YAML has
+// no way to unmarshal a bare enum, and we want to reject an unknown policy
+// name with a clear error rather than silently zero-valuing it.
+type GroupConfig struct {
+	Name   string      `yaml:"name"`
+	Nodes  []string    `yaml:"nodes"`
+	Policy string      `yaml:"policy"`
+	Check  CheckConfig `yaml:"check"`
+}
+
+// policyByName is the set of DialerSelectionPolicy names accepted in
+// GroupConfig.Policy.
+var policyByName = map[string]consts.DialerSelectionPolicy_E{
+	"fixed":                  consts.DialerSelectionPolicy_Fixed,
+	"round_robin":            consts.DialerSelectionPolicy_RoundRobin,
+	"min_latency":            consts.DialerSelectionPolicy_MinLastLatency,
+	"min_average_10_latency": consts.DialerSelectionPolicy_MinAverage10Latencies,
+	"random":                 consts.DialerSelectionPolicy_Random,
+}
+
+// Config is the user-facing description of dae's outbounds, as opposed to
+// the two hardcoded entries NewControlPlane uses. It is consumed by
+// NewControlPlaneFromConfig.
+type Config struct {
+	Groups []GroupConfig `yaml:"groups"`
+	// Mark is the fwmark dae's own dialers carry, so the eBPF programs can
+	// let them bypass tproxy redirection. Defaults to dialer.DefaultMark
+	// when zero.
+	Mark uint32 `yaml:"mark"`
+}
+
+// ParseConfig parses raw YAML into a Config.
+func ParseConfig(raw []byte) (*Config, error) {
+	var cfg Config
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// GroupMeta carries the parts of a GroupConfig that outbound.DialerGroup
+// doesn't itself retain, but that the diagnostic server still wants to
+// report (see DiagServer.handleDialers).
+type GroupMeta struct {
+	Policy string
+	Check  CheckConfig
+}
+
+// BuildOutbounds turns cfg into the []*outbound.DialerGroup consumed by
+// newControlPlane, validating that the number of groups fits in the 8-bit
+// outbound id used by the eBPF maps, that every group has a known policy,
+// and that group names are unique (newControlPlane derives
+// outboundName2Id from the Name alone, so duplicates would silently
+// collide). It also returns each group's GroupMeta, keyed by name.
+func (cfg *Config) BuildOutbounds(log *logrus.Logger) ([]*outbound.DialerGroup, map[string]GroupMeta, error) {
+	if len(cfg.Groups) > 0xff {
+		return nil, nil, fmt.Errorf("too many outbounds: %v > 255", len(cfg.Groups))
+	}
+	outbounds := make([]*outbound.DialerGroup, 0, len(cfg.Groups))
+	meta := make(map[string]GroupMeta, len(cfg.Groups))
+	for _, g := range cfg.Groups {
+		if g.Name == "" {
+			return nil, nil, fmt.Errorf("group has no name")
+		}
+		if _, ok := meta[g.Name]; ok {
+			return nil, nil, fmt.Errorf("duplicate group name %q", g.Name)
+		}
+		if len(g.Nodes) == 0 {
+			return nil, nil, fmt.Errorf("group %q: no nodes configured", g.Name)
+		}
+		policyEnum, ok := policyByName[g.Policy]
+		if !ok {
+			return nil, nil, fmt.Errorf("group %q: unknown policy %q", g.Name, g.Policy)
+		}
+		dialers := make([]*dialer.Dialer, 0, len(g.Nodes))
+		for _, link := range g.Nodes {
+			d, err := dialer.NewFromLink(link)
+			if err != nil {
+				return nil, nil, fmt.Errorf("group %q: %w", g.Name, err)
+			}
+			dialers = append(dialers, d)
+		}
+		outbounds = append(outbounds, outbound.NewDialerGroup(log, g.Name, dialers,
+			outbound.DialerSelectionPolicy{Policy: policyEnum}))
+		meta[g.Name] = GroupMeta{Policy: g.Policy, Check: g.Check}
+	}
+	return outbounds, meta, nil
+}
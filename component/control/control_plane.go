@@ -9,17 +9,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"foo/common"
 	"foo/common/consts"
 	"foo/component/outbound"
 	"foo/component/outbound/dialer"
 	"foo/component/routing"
-	"foo/pkg/pool"
 	"github.com/cilium/ebpf"
 	"github.com/cilium/ebpf/rlimit"
 	"github.com/sirupsen/logrus"
 	"github.com/vishvananda/netlink"
-	"golang.org/x/sys/unix"
 	"net"
 	"net/netip"
 	"os"
@@ -37,6 +34,12 @@ type ControlPlane struct {
 	outboundName2Id map[string]uint8
 	bpf             *bpfObjects
 
+	// routingA is kept so the routing matcher can be rebuilt from scratch,
+	// e.g. after GeoUpdater refreshes the geoip/geosite dat files it reads.
+	routingA string
+
+	// mutex also protects SimulatedLpmTries, SimulatedDomainSet, Final and
+	// epoch, which rebuildRoutingMatcher swaps as a unit.
 	SimulatedLpmTries  [][]netip.Prefix
 	SimulatedDomainSet []DomainSet
 	Final              string
@@ -46,10 +49,77 @@ type ControlPlane struct {
 	dnsCache map[string]*dnsCache
 	epoch    uint32
 
+	// rebuildMu serializes rebuildRoutingMatcher against itself (e.g. two
+	// overlapping GeoUpdater refreshes), so one rebuild's bpf map writes and
+	// epoch bump can't interleave with another's. It does not make a single
+	// rebuild atomic with respect to packets being matched concurrently --
+	// see rebuildRoutingMatcher's doc comment.
+	rebuildMu sync.Mutex
+
+	// flows tracks in-flight TCP/UDP connections for the diagnostic server;
+	// see ListenAndServeDiag.
+	flows *flowTable
+
+	// groupMeta is keyed by outbound group name and carries the Policy/Check
+	// config BuildOutbounds parsed but outbound.DialerGroup doesn't retain
+	// itself, so the diagnostic server can still report it. health holds the
+	// latency samples the prober started below collects for groups that
+	// configured a Check.
+	groupMeta map[string]GroupMeta
+	health    *dialerHealthTracker
+
 	deferFuncs []func() error
 }
 
+// NewControlPlane builds a ControlPlane with the legacy, hardcoded outbound
+// setup (a direct outbound and a "proxy" outbound built by
+// dialer.NewFromLink from socks5://localhost:1080, which dials directly as
+// well since NewFromLink implements no proxy protocol). New callers should prefer
+// NewControlPlaneFromConfig.
 func NewControlPlane(log *logrus.Logger, routingA string) (*ControlPlane, error) {
+	d, err := dialer.NewFromLink("socks5://localhost:1080")
+	if err != nil {
+		return nil, err
+	}
+	outbounds := []*outbound.DialerGroup{
+		outbound.NewDialerGroup(log, consts.OutboundDirect.String(),
+			[]*dialer.Dialer{dialer.FullconeDirectDialer},
+			outbound.DialerSelectionPolicy{
+				Policy:     consts.DialerSelectionPolicy_Fixed,
+				FixedIndex: 0,
+			}),
+		outbound.NewDialerGroup(log, "proxy",
+			[]*dialer.Dialer{d},
+			outbound.DialerSelectionPolicy{
+				Policy: consts.DialerSelectionPolicy_MinAverage10Latencies,
+			}),
+	}
+	return newControlPlane(log, routingA, outbounds, nil, dialer.DefaultMark)
+}
+
+// NewControlPlaneFromConfig builds a ControlPlane whose outbounds are the
+// DialerGroups described by cfg, rather than the hardcoded direct+socks5
+// pair used by NewControlPlane. Routing rules resolve group names against
+// cfg.Groups.
+func NewControlPlaneFromConfig(log *logrus.Logger, routingA string, cfg *Config) (*ControlPlane, error) {
+	outbounds, meta, err := cfg.BuildOutbounds(log)
+	if err != nil {
+		return nil, fmt.Errorf("BuildOutbounds: %w", err)
+	}
+	mark := cfg.Mark
+	if mark == 0 {
+		mark = dialer.DefaultMark
+	}
+	return newControlPlane(log, routingA, outbounds, meta, mark)
+}
+
+// newControlPlane does the actual bpf/routing setup shared by
+// NewControlPlane and NewControlPlaneFromConfig. mark is the fwmark dae's
+// own dialers carry; it is pushed into ParamMap so the tc-attached eBPF
+// programs can recognize and skip packets already originated by dae,
+// avoiding tproxy redirection loops. meta is nil for the legacy
+// NewControlPlane path, which has no per-group Check config to report.
+func newControlPlane(log *logrus.Logger, routingA string, outbounds []*outbound.DialerGroup, meta map[string]GroupMeta, mark uint32) (*ControlPlane, error) {
 	// Allow the current process to lock memory for eBPF resources.
 	if err := rlimit.RemoveMemlock(); err != nil {
 		return nil, fmt.Errorf("rlimit.RemoveMemlock:%v", err)
@@ -92,6 +162,19 @@ retry_load:
 	if err := bpf.ParamMap.Update(consts.DisableL4RxChecksumKey, consts.DisableL4ChecksumPolicy_SetZero, ebpf.UpdateAny); err != nil {
 		return nil, err
 	}
+	// Configure the anti-loop fwmark on both sides: dialer.SetMark makes
+	// every dialer dae opens for its own outbounds carry it (see
+	// component/outbound/dialer/control.go), and writing the same value to
+	// FwmarkBypassKey is how that's communicated to the eBPF program
+	// attached by BindLink. The bypass check itself -- skip tc
+	// redirection when a packet's mark matches this key -- has to live in
+	// the compiled eBPF C source, which (like bpfObjects/bpfIfIp/etc.
+	// throughout this file) is generated out-of-tree and isn't part of
+	// this chunk; it is not included here.
+	dialer.SetMark(mark)
+	if err := bpf.ParamMap.Update(consts.FwmarkBypassKey, mark, ebpf.UpdateAny); err != nil {
+		return nil, err
+	}
 	var epoch uint32
 	bpf.ParamMap.Lookup(consts.EpochKey, &epoch)
 	epoch++
@@ -131,24 +214,6 @@ retry_load:
 		}
 		log.Tracef("RoutingA:\n%vfinal: %v\n", debugBuilder.String(), final)
 	}
-	// TODO:
-	d, err := dialer.NewFromLink("socks5://localhost:1080")
-	if err != nil {
-		return nil, err
-	}
-	outbounds := []*outbound.DialerGroup{
-		outbound.NewDialerGroup(log, consts.OutboundDirect.String(),
-			[]*dialer.Dialer{dialer.FullconeDirectDialer},
-			outbound.DialerSelectionPolicy{
-				Policy:     consts.DialerSelectionPolicy_Fixed,
-				FixedIndex: 0,
-			}),
-		outbound.NewDialerGroup(log, "proxy",
-			[]*dialer.Dialer{d},
-			outbound.DialerSelectionPolicy{
-				Policy: consts.DialerSelectionPolicy_MinAverage10Latencies,
-			}),
-	}
 	// Generate outboundName2Id from outbounds.
 	if len(outbounds) > 0xff {
 		return nil, fmt.Errorf("too many outbounds")
@@ -166,124 +231,112 @@ retry_load:
 	}
 	/**/
 
-	return &ControlPlane{
+	cp := &ControlPlane{
 		log:                log,
 		outbounds:          outbounds,
 		outboundName2Id:    outboundName2Id,
 		bpf:                &bpf,
+		routingA:           routingA,
 		SimulatedLpmTries:  builder.SimulatedLpmTries,
 		SimulatedDomainSet: builder.SimulatedDomainSet,
 		Final:              final,
 		mutex:              sync.Mutex{},
 		dnsCache:           make(map[string]*dnsCache),
 		epoch:              epoch,
+		flows:              newFlowTable(),
+		groupMeta:          meta,
+		health:             newDialerHealthTracker(),
 		deferFuncs:         []func() error{bpf.Close},
-	}, nil
+	}
+	cp.startHealthChecks()
+	return cp, nil
 }
 
-func (c *ControlPlane) BindLink(ifname string) error {
-	link, err := netlink.LinkByName(ifname)
+// rebuildRoutingMatcher re-parses c.routingA, re-applies the routing
+// optimizers (notably DatReaderOptimizer, which reads the geoip/geosite dat
+// files) and rebuilds the LPM tries and domain sets, then writes them into
+// the bpf maps and bumps the EpochKey generation marker in ParamMap.
+//
+// Scope: this does NOT deliver the atomic "in-flight packets keep matching
+// the old epoch until the swap completes" guarantee a true hot-reload
+// needs. builder.Build() writes into the same, live LPM/domain bpf maps
+// packets are currently matched against, so a packet classified while
+// Build is mid-write can observe a partially-rebuilt map; bumping epoch
+// afterwards only updates the generation counter other subsystems read, it
+// does not provide isolation by itself. Getting real atomicity would mean
+// duplicating the matcher's bpf maps per epoch and switching which one the
+// datapath reads, which needs changes to the generated bpf map layout that
+// aren't part of this tree. What rebuildMu does guarantee: two overlapping
+// calls to rebuildRoutingMatcher (e.g. two GeoUpdater refreshes racing each
+// other) can't interleave their map writes or epoch bumps.
+func (c *ControlPlane) rebuildRoutingMatcher() error {
+	c.rebuildMu.Lock()
+	defer c.rebuildMu.Unlock()
+
+	rules, final, err := routing.Parse(c.routingA)
 	if err != nil {
-		return err
+		return fmt.Errorf("routingA error: \n %w", err)
 	}
-	// Insert an elem into IfindexIpsMap.
-	// TODO: We should monitor IP change of the link.
-	ipnets, err := netlink.AddrList(link, netlink.FAMILY_ALL)
-	if err != nil {
-		return err
-	}
-	// TODO: If we monitor IP change of the link, we should remove code below.
-	if len(ipnets) == 0 {
-		return fmt.Errorf("interface %v has no ip", ifname)
+	if rules, err = routing.ApplyRulesOptimizers(rules,
+		&routing.RefineFunctionParamKeyOptimizer{},
+		&routing.DatReaderOptimizer{Logger: c.log},
+		&routing.MergeAndSortRulesOptimizer{},
+		&routing.DeduplicateParamsOptimizer{},
+	); err != nil {
+		return fmt.Errorf("ApplyRulesOptimizers error: \n %w", err)
 	}
-	var linkIp bpfIfIp
-	for _, ipnet := range ipnets {
-		ip, ok := netip.AddrFromSlice(ipnet.IP)
-		if !ok {
-			continue
-		}
-		if ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
-			continue
-		}
-		if (ip.Is6() && linkIp.HasIp6) ||
-			(ip.Is4() && linkIp.HasIp4) {
-			continue
-		}
-		ip6format := ip.As16()
-		if ip.Is4() {
-			linkIp.HasIp4 = true
-			linkIp.Ip4 = common.Ipv6ByteSliceToUint32Array(ip6format[:])
-		} else {
-			linkIp.HasIp6 = true
-			linkIp.Ip6 = common.Ipv6ByteSliceToUint32Array(ip6format[:])
-		}
-		if linkIp.HasIp4 && linkIp.HasIp6 {
-			break
-		}
+	builder := NewRoutingMatcherBuilder(c.outboundName2Id, c.bpf)
+	if err := routing.ApplyMatcherBuilder(builder, rules, final); err != nil {
+		return fmt.Errorf("ApplyMatcherBuilder: %w", err)
 	}
-	if err := c.bpf.IfindexIpMap.Update(uint32(link.Attrs().Index), linkIp, ebpf.UpdateAny); err != nil {
-		return fmt.Errorf("update IfindexIpsMap: %w", err)
+	if err := builder.Build(); err != nil {
+		return fmt.Errorf("RoutingMatcherBuilder.Build: %w", err)
 	}
 
-	// Insert qdisc and filters.
-	qdisc := &netlink.GenericQdisc{
-		QdiscAttrs: netlink.QdiscAttrs{
-			LinkIndex: link.Attrs().Index,
-			Handle:    netlink.MakeHandle(0xffff, 0),
-			Parent:    netlink.HANDLE_CLSACT,
-		},
-		QdiscType: "clsact",
-	}
-	if err := netlink.QdiscAdd(qdisc); err != nil {
-		if os.IsExist(err) {
-			_ = netlink.QdiscDel(qdisc)
-			err = netlink.QdiscAdd(qdisc)
-		}
+	c.mutex.Lock()
+	c.SimulatedLpmTries = builder.SimulatedLpmTries
+	c.SimulatedDomainSet = builder.SimulatedDomainSet
+	c.Final = final
+	c.epoch++
+	epoch := c.epoch
+	c.mutex.Unlock()
 
-		if err != nil {
-			return fmt.Errorf("cannot add clsact qdisc: %w", err)
-		}
+	if err := c.bpf.ParamMap.Update(consts.EpochKey, epoch, ebpf.UpdateAny); err != nil {
+		return fmt.Errorf("bump epoch: %w", err)
 	}
-	c.deferFuncs = append(c.deferFuncs, func() error {
-		return netlink.QdiscDel(qdisc)
-	})
+	return nil
+}
 
-	filter := &netlink.BpfFilter{
-		FilterAttrs: netlink.FilterAttrs{
-			LinkIndex: link.Attrs().Index,
-			Parent:    netlink.HANDLE_MIN_INGRESS,
-			Handle:    netlink.MakeHandle(0, 1),
-			Protocol:  unix.ETH_P_ALL,
-			Priority:  0,
-		},
-		Fd:           c.bpf.bpfPrograms.TproxyIngress.FD(),
-		Name:         consts.AppName + "_ingress",
-		DirectAction: true,
+// BindLink attaches the clsact qdisc and tproxy ingress/egress filters to
+// ifname, and starts a goroutine that keeps IfindexIpMap in sync with the
+// link's addresses for as long as the ControlPlane is alive.
+func (c *ControlPlane) BindLink(ifname string) error {
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return err
 	}
-	if err := netlink.FilterAdd(filter); err != nil {
-		return fmt.Errorf("cannot attach ebpf object to filter ingress: %w", err)
+	lm := &linkMonitor{
+		log:    c.log,
+		bpf:    c.bpf,
+		ifname: ifname,
 	}
-	c.deferFuncs = append(c.deferFuncs, func() error {
-		return netlink.FilterDel(filter)
-	})
-	filterEgress := &netlink.BpfFilter{
-		FilterAttrs: netlink.FilterAttrs{
-			LinkIndex: link.Attrs().Index,
-			Parent:    netlink.HANDLE_MIN_EGRESS,
-			Handle:    netlink.MakeHandle(0, 1),
-			Protocol:  unix.ETH_P_ALL,
-			Priority:  0,
-		},
-		Fd:           c.bpf.bpfPrograms.TproxyEgress.FD(),
-		Name:         consts.AppName + "_egress",
-		DirectAction: true,
-	}
-	if err := netlink.FilterAdd(filterEgress); err != nil {
-		return fmt.Errorf("cannot attach ebpf object to filter ingress: %w", err)
+	if err := lm.attach(link); err != nil {
+		return err
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
 	c.deferFuncs = append(c.deferFuncs, func() error {
-		return netlink.FilterDel(filter)
+		cancel()
+		// Wait for run's deferred detach to actually remove the
+		// qdisc/filters before Close returns, so callers can rely on
+		// teardown being complete (e.g. before rebinding the same link).
+		<-done
+		return nil
 	})
+	go func() {
+		defer close(done)
+		lm.run(ctx)
+	}()
 	return nil
 }
 
@@ -324,6 +377,8 @@ func (c *ControlPlane) ListenAndServe(port uint16) (err error) {
 				break
 			}
 			go func() {
+				id := c.flows.add("tcp", lconn.LocalAddr().String(), lconn.RemoteAddr().String(), "")
+				defer c.flows.remove(id)
 				if err := c.handleConn(lconn); err != nil {
 					c.log.Warnln("handleConn:", err)
 				}
@@ -332,29 +387,7 @@ func (c *ControlPlane) ListenAndServe(port uint16) (err error) {
 	}()
 	go func() {
 		defer cancel()
-		for {
-			var buf [65536]byte
-			n, lAddrPort, err := lConn.ReadFromUDPAddrPort(buf[:])
-			if err != nil {
-				if !strings.Contains(err.Error(), "use of closed network connection") {
-					c.log.Errorf("ReadFromUDPAddrPort: %v, %v", lAddrPort.String(), err)
-				}
-				break
-			}
-			addrHdr, dataOffset, err := ParseAddrHdr(buf[:n])
-			if err != nil {
-				c.log.Warnf("No AddrPort presented")
-				continue
-			}
-			newBuf := pool.Get(n - dataOffset)
-			copy(newBuf, buf[dataOffset:n])
-			go func(data []byte, lConn *net.UDPConn, lAddrPort netip.AddrPort, addrHdr *AddrHdr) {
-				if e := c.handlePkt(newBuf, lConn, lAddrPort, addrHdr); e != nil {
-					c.log.Warnln("handlePkt:", e)
-				}
-				pool.Put(newBuf)
-			}(newBuf, lConn, lAddrPort, addrHdr)
-		}
+		c.serveUDP(lConn)
 	}()
 	<-ctx.Done()
 	return nil
@@ -0,0 +1,343 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) since 2022, mzz2017 (mzz@tuta.io). All rights reserved.
+ */
+
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+)
+
+// dialerHealthTracker records recent latency samples and the current
+// selection for each outbound group that configured a Check, so
+// DiagServer.handleDialers has something real to report instead of just
+// group names.
+type dialerHealthTracker struct {
+	mu     sync.Mutex
+	byName map[string]*groupHealth
+}
+
+// groupHealth is one group's rolling health state.
+type groupHealth struct {
+	// Samples holds the latency of the last few successful checks,
+	// oldest first. There is one sample stream per group (probed via a
+	// single Check.Url), not one per node, so this does not expose
+	// per-node latency.
+	Samples []time.Duration
+	// MinLatencySampleIdx is the index into Samples of the lowest
+	// recorded latency. It is NOT the dialer outbound.DialerGroup
+	// actually selected for traffic -- this tracker has no visibility
+	// into that selection, it only knows what it itself measured against
+	// Check.Url. It is reported as "min_latency_sample_idx" by
+	// /debug/dialers and is a group-level measurement only.
+	MinLatencySampleIdx int
+	LastErr             string
+}
+
+const dialerHealthWindow = 10
+
+func newDialerHealthTracker() *dialerHealthTracker {
+	return &dialerHealthTracker{byName: make(map[string]*groupHealth)}
+}
+
+func (t *dialerHealthTracker) record(name string, d time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h, ok := t.byName[name]
+	if !ok {
+		h = &groupHealth{}
+		t.byName[name] = h
+	}
+	if err != nil {
+		h.LastErr = err.Error()
+		return
+	}
+	h.LastErr = ""
+	h.Samples = append(h.Samples, d)
+	if len(h.Samples) > dialerHealthWindow {
+		h.Samples = h.Samples[len(h.Samples)-dialerHealthWindow:]
+	}
+	best := 0
+	for i, s := range h.Samples {
+		if s < h.Samples[best] {
+			best = i
+		}
+	}
+	h.MinLatencySampleIdx = best
+}
+
+func (t *dialerHealthTracker) snapshot(name string) (h groupHealth, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	g, ok := t.byName[name]
+	if !ok {
+		return groupHealth{}, false
+	}
+	return *g, true
+}
+
+// startHealthChecks launches one goroutine per outbound group that
+// configured a Check in its GroupMeta, periodically timing a GET to
+// Check.Url and feeding the result into c.health. Groups without a Check
+// (including both of NewControlPlane's hardcoded outbounds) are skipped.
+func (c *ControlPlane) startHealthChecks() {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := false
+	for name, m := range c.groupMeta {
+		if m.Check.Url == "" {
+			continue
+		}
+		started = true
+		name, m := name, m
+		interval := m.Check.Interval
+		if interval <= 0 {
+			interval = 30 * time.Second
+		}
+		timeout := m.Check.Timeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		client := &http.Client{Timeout: timeout}
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					start := time.Now()
+					resp, err := client.Get(m.Check.Url)
+					if err == nil {
+						resp.Body.Close()
+					}
+					c.health.record(name, time.Since(start), err)
+				}
+			}
+		}()
+	}
+	if started {
+		c.deferFuncs = append(c.deferFuncs, func() error {
+			cancel()
+			return nil
+		})
+	} else {
+		cancel()
+	}
+}
+
+// flowTable tracks in-flight TCP/UDP flows for the diagnostic server.
+// The goroutines that run handleConn/handlePkt register a flow before the
+// call and unregister it when the call returns.
+type flowTable struct {
+	mu    sync.Mutex
+	flows map[uint64]*FlowInfo
+	next  uint64
+}
+
+// FlowInfo is a snapshot of one in-flight flow, as reported by /debug/flows.
+type FlowInfo struct {
+	Id        uint64    `json:"id"`
+	Proto     string    `json:"proto"`
+	Local     string    `json:"local"`
+	Remote    string    `json:"remote"`
+	Outbound  string    `json:"outbound"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+func newFlowTable() *flowTable {
+	return &flowTable{flows: make(map[uint64]*FlowInfo)}
+}
+
+func (t *flowTable) add(proto, local, remote, outbound string) (id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.next++
+	id = t.next
+	t.flows[id] = &FlowInfo{
+		Id:        id,
+		Proto:     proto,
+		Local:     local,
+		Remote:    remote,
+		Outbound:  outbound,
+		StartedAt: time.Now(),
+	}
+	return id
+}
+
+func (t *flowTable) remove(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.flows, id)
+}
+
+func (t *flowTable) list() []*FlowInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	flows := make([]*FlowInfo, 0, len(t.flows))
+	for _, f := range t.flows {
+		flows = append(flows, f)
+	}
+	return flows
+}
+
+// DiagServer is an opt-in HTTP server exposing ControlPlane internals
+// (the epoch, the routing matcher's simulated LPM tries and domain sets,
+// dialer health, the DNS cache and in-flight flows) for triaging routing
+// mismatches in production. It reads no eBPF map itself: IfindexIpMap and
+// the other ParamMap keys (tproxy port, checksum policies) are not reported.
+// ListenAndServeDiag enforces that it only ever binds to loopback.
+type DiagServer struct {
+	cp     *ControlPlane
+	server *http.Server
+}
+
+// NewDiagServer builds (but does not start) a diagnostic server for cp.
+func NewDiagServer(cp *ControlPlane) *DiagServer {
+	d := &DiagServer{cp: cp}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/maps", d.handleMaps)
+	mux.HandleFunc("/debug/dialers", d.handleDialers)
+	mux.HandleFunc("/debug/flows", d.handleFlows)
+	mux.HandleFunc("/debug/dns", d.handleDns)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	d.server = &http.Server{Handler: mux}
+	return d
+}
+
+// ListenAndServeDiag starts the diagnostic server on addr (e.g.
+// "127.0.0.1:2023" or just ":2023") and registers its shutdown with
+// cp.deferFuncs. It returns once the listener is up; serving happens in
+// the background.
+//
+// addr's host must be loopback (or empty, which defaults to 127.0.0.1):
+// this endpoint dumps internal state and mounts pprof, so unlike
+// ListenAndServe it is not meant to be reachable off-box. Callers who
+// really want LAN/WAN exposure must put a reverse proxy with its own auth
+// in front of it rather than binding this server to a non-loopback
+// address.
+func (cp *ControlPlane) ListenAndServeDiag(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid diag addr %q: %w", addr, err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	} else if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("diag server must bind to loopback, got %q", addr)
+	}
+	addr = net.JoinHostPort(host, port)
+
+	d := NewDiagServer(cp)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen diag: %w", err)
+	}
+	cp.deferFuncs = append(cp.deferFuncs, func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return d.server.Shutdown(ctx)
+	})
+	go func() {
+		if err := d.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			cp.log.Warnf("diag server: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (d *DiagServer) handleMaps(w http.ResponseWriter, r *http.Request) {
+	d.cp.mutex.Lock()
+	resp := struct {
+		Epoch              uint32               `json:"epoch"`
+		SimulatedLpmTries  [][]string           `json:"simulated_lpm_tries"`
+		SimulatedDomainSet []DomainSet          `json:"simulated_domain_set"`
+		OutboundName2Id    map[string]uint8     `json:"outbound_name_to_id"`
+	}{
+		Epoch:              d.cp.epoch,
+		SimulatedDomainSet: d.cp.SimulatedDomainSet,
+		OutboundName2Id:    d.cp.outboundName2Id,
+	}
+	resp.SimulatedLpmTries = make([][]string, len(d.cp.SimulatedLpmTries))
+	for i, prefixes := range d.cp.SimulatedLpmTries {
+		strs := make([]string, len(prefixes))
+		for j, p := range prefixes {
+			strs[j] = p.String()
+		}
+		resp.SimulatedLpmTries[i] = strs
+	}
+	d.cp.mutex.Unlock()
+	writeJson(w, resp)
+}
+
+func (d *DiagServer) handleDialers(w http.ResponseWriter, r *http.Request) {
+	type dialerGroupInfo struct {
+		Name     string `json:"name"`
+		Policy   string `json:"policy,omitempty"`
+		CheckUrl string `json:"check_url,omitempty"`
+		// LatencySamples come from a single probe against CheckUrl per
+		// group, not per node: this is the group's own health signal, not
+		// a per-dialer breakdown.
+		LatencySamples []time.Duration `json:"latency_samples,omitempty"`
+		// MinLatencySampleIdx is the index into LatencySamples with the
+		// lowest latency seen. It is NOT the dialer outbound.DialerGroup
+		// actually selected for traffic -- the diag server doesn't observe
+		// that selection, only what it measures itself.
+		MinLatencySampleIdx int    `json:"min_latency_sample_idx,omitempty"`
+		LastCheckError      string `json:"last_check_error,omitempty"`
+	}
+	infos := make([]dialerGroupInfo, 0, len(d.cp.outbounds))
+	for _, g := range d.cp.outbounds {
+		info := dialerGroupInfo{Name: g.Name}
+		if m, ok := d.cp.groupMeta[g.Name]; ok {
+			info.Policy = m.Policy
+			info.CheckUrl = m.Check.Url
+		}
+		if h, ok := d.cp.health.snapshot(g.Name); ok {
+			info.LatencySamples = h.Samples
+			info.MinLatencySampleIdx = h.MinLatencySampleIdx
+			info.LastCheckError = h.LastErr
+		}
+		infos = append(infos, info)
+	}
+	writeJson(w, infos)
+}
+
+func (d *DiagServer) handleFlows(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, d.cp.flows.list())
+}
+
+func (d *DiagServer) handleDns(w http.ResponseWriter, r *http.Request) {
+	// Copying the map only protects iteration here; the *dnsCache pointers
+	// themselves are still shared with whatever resolves names under
+	// d.cp.mutex, so marshal while still holding the lock instead of
+	// releasing it and encoding a possibly-concurrently-mutated entry.
+	d.cp.mutex.Lock()
+	b, err := json.Marshal(d.cp.dnsCache)
+	d.cp.mutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) since 2022, mzz2017 (mzz@tuta.io). All rights reserved.
+ */
+
+package control
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrUpdateInProgress is returned by GeoUpdater.UpdateGeoDatabases when a refresh is
+// already running.
+var ErrUpdateInProgress = errors.New("geo database update already in progress")
+
+// GeoDatFile is one geoip/geosite dat file that GeoUpdater keeps fresh,
+// e.g. the files consumed by routing.DatReaderOptimizer.
+type GeoDatFile struct {
+	// Path is where the dat file lives on disk; Path+".sha256sum" is the
+	// local sidecar GeoUpdater records its own previous download's hash
+	// in, purely to skip a no-op swap when the upstream content hasn't
+	// changed. It is not a source of truth for integrity.
+	Path string
+	// Url is downloaded to refresh Path.
+	Url string
+	// ChecksumUrl, if set, is fetched and must contain the sha256 of the
+	// content at Url (as published by the upstream, e.g.
+	// "<Url>.sha256sum"); a downloaded file that doesn't match is
+	// rejected and never swapped in. This is the actual integrity check:
+	// without it, a corrupted or MITM'd download would have nothing to
+	// be compared against other than itself.
+	ChecksumUrl string
+}
+
+// GeoUpdater periodically re-downloads the geoip/geosite dat files used by
+// routing.DatReaderOptimizer, verifies them against ChecksumUrl when
+// configured, and atomically swaps them into place before asking the
+// owning ControlPlane to rebuild its routing matcher.
+type GeoUpdater struct {
+	log    *logrus.Logger
+	cp     *ControlPlane
+	files  []GeoDatFile
+	client *http.Client
+
+	updating atomic.Bool
+}
+
+// NewGeoUpdater builds a GeoUpdater for the given dat files.
+func NewGeoUpdater(log *logrus.Logger, cp *ControlPlane, files []GeoDatFile) *GeoUpdater {
+	return &GeoUpdater{
+		log:    log,
+		cp:     cp,
+		files:  files,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// UpdateGeoDatabases downloads every configured dat file, verifies it
+// against its ChecksumUrl when one is set, atomically replaces the file on disk if it changed, and, if any
+// file changed, rebuilds the routing matcher. It returns
+// ErrUpdateInProgress if a refresh is already running.
+func (u *GeoUpdater) UpdateGeoDatabases() error {
+	if !u.updating.CompareAndSwap(false, true) {
+		return ErrUpdateInProgress
+	}
+	defer u.updating.Store(false)
+
+	var changed bool
+	for _, f := range u.files {
+		ok, err := u.updateOne(f)
+		if err != nil {
+			return fmt.Errorf("update %v: %w", f.Path, err)
+		}
+		changed = changed || ok
+	}
+	if !changed {
+		return nil
+	}
+	return u.cp.rebuildRoutingMatcher()
+}
+
+// updateOne downloads f.Url, verifies it against f.ChecksumUrl when set
+// (rejecting the download outright on mismatch), and if its sha256 differs
+// from the local sidecar recorded alongside f.Path, atomically replaces
+// f.Path and the sidecar.
+func (u *GeoUpdater) updateOne(f GeoDatFile) (changed bool, err error) {
+	resp, err := u.client.Get(f.Url)
+	if err != nil {
+		return false, fmt.Errorf("download: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("download: unexpected status %v", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("read body: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	sumHex := hex.EncodeToString(sum[:])
+
+	if f.ChecksumUrl != "" {
+		want, err := u.fetchChecksum(f.ChecksumUrl)
+		if err != nil {
+			return false, fmt.Errorf("fetch checksum: %w", err)
+		}
+		if want != sumHex {
+			return false, fmt.Errorf("checksum mismatch: got %v, want %v (from %v)", sumHex, want, f.ChecksumUrl)
+		}
+	} else {
+		u.log.Warnf("GeoUpdater: %v has no ChecksumUrl configured, download integrity is not verified", f.Path)
+	}
+
+	sumPath := f.Path + ".sha256sum"
+	if old, err := os.ReadFile(sumPath); err == nil && string(old) == sumHex {
+		return false, nil
+	}
+
+	tmp := f.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return false, fmt.Errorf("write temp file: %w", err)
+	}
+	if err := os.Rename(tmp, f.Path); err != nil {
+		return false, fmt.Errorf("rename into place: %w", err)
+	}
+	if err := os.WriteFile(sumPath, []byte(sumHex), 0644); err != nil {
+		return false, fmt.Errorf("write sidecar: %w", err)
+	}
+	return true, nil
+}
+
+// fetchChecksum downloads and parses a "<hex sha256>[  filename]" sidecar
+// published by the upstream at checksumUrl, as e.g. sha256sum(1) produces.
+func (u *GeoUpdater) fetchChecksum(checksumUrl string) (string, error) {
+	resp, err := u.client.Get(checksumUrl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	sum := strings.Fields(string(body))
+	if len(sum) == 0 {
+		return "", fmt.Errorf("empty checksum response")
+	}
+	return strings.ToLower(strings.TrimSpace(sum[0])), nil
+}
+
+// RegisterGeoUpdater starts a ticker that calls UpdateGeoDatabases every
+// interval, invoking onSuccess after every call that returns nil, including
+// calls in which no file had changed and nothing was swapped in. It hooks
+// its shutdown into cp.deferFuncs.
+func (cp *ControlPlane) RegisterGeoUpdater(files []GeoDatFile, interval time.Duration, onSuccess func()) *GeoUpdater {
+	u := NewGeoUpdater(cp.log, cp, files)
+	ctx, cancel := context.WithCancel(context.Background())
+	cp.deferFuncs = append(cp.deferFuncs, func() error {
+		cancel()
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := u.UpdateGeoDatabases(); err != nil {
+					if !errors.Is(err, ErrUpdateInProgress) {
+						cp.log.Warnf("GeoUpdater: %v", err)
+					}
+					continue
+				}
+				if onSuccess != nil {
+					onSuccess()
+				}
+			}
+		}
+	}()
+	return u
+}
@@ -0,0 +1,259 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) since 2022, mzz2017 (mzz@tuta.io). All rights reserved.
+ */
+
+package control
+
+import (
+	"context"
+	"fmt"
+	"foo/common"
+	"foo/common/consts"
+	"net"
+	"net/netip"
+	"os"
+
+	"github.com/cilium/ebpf"
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// linkMonitor keeps the eBPF IfindexIpMap and the tc clsact/filters of a
+// single link in sync with netlink events, so BindLink can be called
+// before the link has any address assigned (e.g. DHCP/hotplug) and will
+// keep working across link flaps.
+type linkMonitor struct {
+	log    *logrus.Logger
+	bpf    *bpfObjects
+	ifname string
+
+	ifindex  int
+	attached bool
+	lastIp   bpfIfIp
+	// wasUp is the link's carrier/admin state as of the last attach or
+	// RTM_NEWLINK we acted on, so run can tell an up->down->up bounce
+	// (which needs reattachFilters) apart from the routine NEWLINK churn
+	// (MTU, flags, stats) that fires constantly and must not reattach.
+	wasUp bool
+}
+
+// attach installs the clsact qdisc and ingress/egress filters on link, and
+// pushes whatever addresses are currently assigned into IfindexIpMap. It no
+// longer fails when the link has no address yet; run will retry once an
+// RTM_NEWADDR event arrives.
+func (lm *linkMonitor) attach(link netlink.Link) error {
+	lm.ifindex = link.Attrs().Index
+	lm.wasUp = link.Attrs().Flags&net.FlagUp != 0
+	if err := lm.reattachFilters(link); err != nil {
+		return err
+	}
+	ipnets, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+	lm.updateAddrs(ipnets)
+	return nil
+}
+
+func (lm *linkMonitor) reattachFilters(link netlink.Link) error {
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscAdd(qdisc); err != nil {
+		if os.IsExist(err) {
+			_ = netlink.QdiscDel(qdisc)
+			err = netlink.QdiscAdd(qdisc)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot add clsact qdisc: %w", err)
+		}
+	}
+
+	filter := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_INGRESS,
+			Handle:    netlink.MakeHandle(0, 1),
+			Protocol:  unix.ETH_P_ALL,
+			Priority:  0,
+		},
+		Fd:           lm.bpf.bpfPrograms.TproxyIngress.FD(),
+		Name:         consts.AppName + "_ingress",
+		DirectAction: true,
+	}
+	if err := netlink.FilterAdd(filter); err != nil {
+		return fmt.Errorf("cannot attach ebpf object to filter ingress: %w", err)
+	}
+	filterEgress := &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_EGRESS,
+			Handle:    netlink.MakeHandle(0, 1),
+			Protocol:  unix.ETH_P_ALL,
+			Priority:  0,
+		},
+		Fd:           lm.bpf.bpfPrograms.TproxyEgress.FD(),
+		Name:         consts.AppName + "_egress",
+		DirectAction: true,
+	}
+	if err := netlink.FilterAdd(filterEgress); err != nil {
+		return fmt.Errorf("cannot attach ebpf object to filter egress: %w", err)
+	}
+	lm.attached = true
+	return nil
+}
+
+// detach removes the qdisc (and with it, the filters) from the link. It is
+// best-effort: the link may already be gone (e.g. LinkDel fired first).
+func (lm *linkMonitor) detach() {
+	if !lm.attached {
+		return
+	}
+	_ = netlink.QdiscDel(&netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: lm.ifindex,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	})
+	lm.attached = false
+}
+
+// updateAddrs recomputes bpfIfIp from ipnets and pushes it into
+// IfindexIpMap if it changed.
+func (lm *linkMonitor) updateAddrs(ipnets []netlink.Addr) {
+	var linkIp bpfIfIp
+	for _, ipnet := range ipnets {
+		ip, ok := netip.AddrFromSlice(ipnet.IP)
+		if !ok {
+			continue
+		}
+		if ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+			continue
+		}
+		if (ip.Is6() && linkIp.HasIp6) ||
+			(ip.Is4() && linkIp.HasIp4) {
+			continue
+		}
+		ip6format := ip.As16()
+		if ip.Is4() {
+			linkIp.HasIp4 = true
+			linkIp.Ip4 = common.Ipv6ByteSliceToUint32Array(ip6format[:])
+		} else {
+			linkIp.HasIp6 = true
+			linkIp.Ip6 = common.Ipv6ByteSliceToUint32Array(ip6format[:])
+		}
+		if linkIp.HasIp4 && linkIp.HasIp6 {
+			break
+		}
+	}
+	if linkIp == lm.lastIp {
+		return
+	}
+	if err := lm.bpf.IfindexIpMap.Update(uint32(lm.ifindex), linkIp, ebpf.UpdateAny); err != nil {
+		lm.log.Warnf("update IfindexIpMap for %v: %v", lm.ifname, err)
+		return
+	}
+	lm.lastIp = linkIp
+}
+
+// run subscribes to netlink address and link events and keeps this link's
+// state current until ctx is cancelled, at which point it tears down the
+// qdisc/filters it installed.
+func (lm *linkMonitor) run(ctx context.Context) {
+	defer lm.detach()
+
+	addrCh := make(chan netlink.AddrUpdate)
+	if err := netlink.AddrSubscribeWithOptions(addrCh, ctx.Done(), netlink.AddrSubscribeOptions{
+		ErrorCallback: func(err error) {
+			lm.log.Warnf("AddrSubscribe(%v): %v", lm.ifname, err)
+		},
+	}); err != nil {
+		lm.log.Warnf("AddrSubscribeWithOptions(%v): %v", lm.ifname, err)
+		return
+	}
+	linkCh := make(chan netlink.LinkUpdate)
+	if err := netlink.LinkSubscribeWithOptions(linkCh, ctx.Done(), netlink.LinkSubscribeOptions{
+		ErrorCallback: func(err error) {
+			lm.log.Warnf("LinkSubscribe(%v): %v", lm.ifname, err)
+		},
+	}); err != nil {
+		lm.log.Warnf("LinkSubscribeWithOptions(%v): %v", lm.ifname, err)
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case u, ok := <-addrCh:
+			if !ok {
+				return
+			}
+			if u.LinkIndex != lm.ifindex {
+				continue
+			}
+			link, err := netlink.LinkByIndex(lm.ifindex)
+			if err != nil {
+				continue
+			}
+			ipnets, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+			if err != nil {
+				lm.log.Warnf("AddrList(%v) after netlink event: %v", lm.ifname, err)
+				continue
+			}
+			lm.updateAddrs(ipnets)
+		case u, ok := <-linkCh:
+			if !ok {
+				return
+			}
+			if u.Link.Attrs().Name != lm.ifname {
+				continue
+			}
+			switch {
+			case u.Header.Type == unix.RTM_DELLINK:
+				lm.detach()
+				// The link is gone, so there's no carrier state to compare
+				// against anymore. Reset wasUp so that a link coming back
+				// UP counts as cameUp; detach has also cleared lm.attached,
+				// so the NEWLINK branch reattaches it either way.
+				lm.wasUp = false
+			case u.Header.Type == unix.RTM_NEWLINK:
+				// RTM_NEWLINK fires on routine changes (MTU, stats, flags
+				// unrelated to carrier) too, so only reattach when the
+				// ifindex actually changed (reused after the link was
+				// recreated), the link just came up from being down, or we
+				// aren't currently attached (e.g. recovering from a DELLINK)
+				// -- otherwise we'd drop and recreate the qdisc/filters on
+				// every such event, opening a window with no tproxy
+				// redirection and spamming FilterAdd.
+				up := u.Link.Attrs().Flags&net.FlagUp != 0
+				idxChanged := u.Link.Attrs().Index != lm.ifindex
+				cameUp := up && !lm.wasUp
+				lm.wasUp = up
+				if !idxChanged && !cameUp && lm.attached {
+					continue
+				}
+				lm.ifindex = u.Link.Attrs().Index
+				if err := lm.reattachFilters(u.Link); err != nil {
+					lm.log.Warnf("reattach filters on %v: %v", lm.ifname, err)
+					continue
+				}
+				ipnets, err := netlink.AddrList(u.Link, netlink.FAMILY_ALL)
+				if err != nil {
+					lm.log.Warnf("AddrList(%v) after link event: %v", lm.ifname, err)
+					continue
+				}
+				lm.updateAddrs(ipnets)
+			}
+		}
+	}
+}
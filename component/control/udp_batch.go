@@ -0,0 +1,177 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) since 2022, mzz2017 (mzz@tuta.io). All rights reserved.
+ */
+
+package control
+
+import (
+	"foo/pkg/pool"
+	"net"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// udpBatchSize is how many messages we ask the kernel for per
+	// recvmmsg(2) call.
+	udpBatchSize = 32
+	// udpGROSegmentSize is the size of each batch slot's receive buffer,
+	// which holds one datagram or one UDP_GRO-coalesced run of segments.
+	udpGROSegmentSize = 65507
+)
+
+// TODO: this only batches the read side (recvmmsg + UDP_GRO). The reply
+// path still writes one datagram per handlePkt call; a sendmmsg/WriteBatch
+// + UDP_SEGMENT (GSO) fast path for writes is not implemented here because
+// it needs to live at handlePkt's send call sites, which this chunk
+// doesn't touch.
+
+// probeUDPGRO reports whether UDP_GRO can be enabled on conn. GRO lets the
+// kernel coalesce many small datagrams (e.g. QUIC, WireGuard) into a single
+// large buffer we read with one recvmmsg slot, which is the whole point of
+// the batch path below. When the kernel doesn't support it (older kernels,
+// non-Linux), we still benefit from batching reads with recvmmsg, just
+// without coalescing.
+func probeUDPGRO(conn *net.UDPConn) bool {
+	sc, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var enabled bool
+	_ = sc.Control(func(fd uintptr) {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_UDP, unix.UDP_GRO, 1); err == nil {
+			enabled = true
+		}
+	})
+	return enabled
+}
+
+// serveUDP reads datagrams off lConn and dispatches each to handlePkt. It
+// prefers a batched recvmmsg path (optionally with UDP_GRO segment
+// coalescing) and falls back to the single-packet path used previously if
+// the kernel doesn't support it.
+//
+// UDP_GRO is only probed (and enabled) once the batch path itself is
+// confirmed available: serveUDPSingle has no idea how to de-segment a
+// GRO-coalesced buffer, so leaving GRO on and falling back to it would
+// silently corrupt/drop coalesced datagrams.
+func (c *ControlPlane) serveUDP(lConn *net.UDPConn) {
+	pc := ipv4.NewPacketConn(lConn)
+	if err := pc.SetReadBatchSize(udpBatchSize); err != nil {
+		c.log.Debugf("UDP batch read not available, falling back to single-packet reads: %v", err)
+		c.serveUDPSingle(lConn)
+		return
+	}
+	gro := probeUDPGRO(lConn)
+	c.log.Debugf("Serving UDP with recvmmsg batching (gro=%v)", gro)
+	c.serveUDPBatch(lConn, pc, gro)
+}
+
+// serveUDPSingle is the pre-batching fallback: one ReadFromUDPAddrPort per
+// datagram into a stack buffer.
+func (c *ControlPlane) serveUDPSingle(lConn *net.UDPConn) {
+	for {
+		var buf [65536]byte
+		n, lAddrPort, err := lConn.ReadFromUDPAddrPort(buf[:])
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				c.log.Errorf("ReadFromUDPAddrPort: %v, %v", lAddrPort.String(), err)
+			}
+			return
+		}
+		c.dispatchUDPSegment(lConn, lAddrPort, buf[:n])
+	}
+}
+
+// serveUDPBatch drives recvmmsg-based batch reads via pc, splitting any
+// UDP_GRO-coalesced buffer into its individual segments before dispatch.
+func (c *ControlPlane) serveUDPBatch(lConn *net.UDPConn, pc *ipv4.PacketConn, gro bool) {
+	bufs := make([][]byte, udpBatchSize)
+	msgs := make([]ipv4.Message, udpBatchSize)
+	for i := range msgs {
+		bufs[i] = make([]byte, udpGROSegmentSize)
+		msgs[i].Buffers = [][]byte{bufs[i]}
+		msgs[i].OOB = make([]byte, 64)
+	}
+
+	for {
+		n, err := pc.ReadBatch(msgs, 0)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed network connection") {
+				c.log.Errorf("ReadBatch: %v", err)
+			}
+			return
+		}
+		for i := 0; i < n; i++ {
+			msg := msgs[i]
+			lAddrPort, ok := udpAddrToAddrPort(msg.Addr)
+			if !ok {
+				continue
+			}
+			segSize := msg.N
+			if gro {
+				if s := groSegmentSize(msg.OOB[:msg.NN]); s > 0 {
+					segSize = s
+				}
+			}
+			for off := 0; off < msg.N; off += segSize {
+				end := off + segSize
+				if end > msg.N {
+					end = msg.N
+				}
+				c.dispatchUDPSegment(lConn, lAddrPort, msg.Buffers[0][off:end])
+			}
+		}
+	}
+}
+
+// dispatchUDPSegment parses one already-demultiplexed datagram (a whole
+// packet, or one GRO segment of a coalesced buffer) and hands it off to
+// handlePkt on its own goroutine, using pool-allocated storage so the
+// shared batch buffer can be reused for the next ReadBatch.
+func (c *ControlPlane) dispatchUDPSegment(lConn *net.UDPConn, lAddrPort netip.AddrPort, seg []byte) {
+	addrHdr, dataOffset, err := ParseAddrHdr(seg)
+	if err != nil {
+		c.log.Warnf("No AddrPort presented")
+		return
+	}
+	newBuf := pool.Get(len(seg) - dataOffset)
+	copy(newBuf, seg[dataOffset:])
+	go func() {
+		id := c.flows.add("udp", lConn.LocalAddr().String(), lAddrPort.String(), "")
+		defer c.flows.remove(id)
+		if e := c.handlePkt(newBuf, lConn, lAddrPort, addrHdr); e != nil {
+			c.log.Warnln("handlePkt:", e)
+		}
+		pool.Put(newBuf)
+	}()
+}
+
+// groSegmentSize extracts the UDP_GRO segment size from a cmsg buffer, or 0
+// if none was present.
+func groSegmentSize(oob []byte) int {
+	scms, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, scm := range scms {
+		if scm.Header.Level == unix.SOL_UDP && scm.Header.Type == unix.UDP_GRO && len(scm.Data) >= 2 {
+			return int(scm.Data[0]) | int(scm.Data[1])<<8
+		}
+	}
+	return 0
+}
+
+// udpAddrToAddrPort converts the net.Addr returned by ReadBatch into a
+// netip.AddrPort, mirroring net.UDPAddr.AddrPort().
+func udpAddrToAddrPort(addr net.Addr) (netip.AddrPort, bool) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || udpAddr == nil {
+		return netip.AddrPort{}, false
+	}
+	return udpAddr.AddrPort(), true
+}
@@ -0,0 +1,76 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) since 2022, mzz2017 (mzz@tuta.io). All rights reserved.
+ */
+
+package dialer
+
+import (
+	"sync/atomic"
+	"syscall"
+)
+
+// DefaultMark is the fwmark dae's own outbound dialers carry by default so
+// the eBPF programs can recognize and skip them, avoiding tproxy loops. It
+// is deliberately distinctive (0xdae) to make it easy to spot in `ip rule`
+// / `nft` output.
+const DefaultMark uint32 = 0xdae
+
+// mark is the fwmark applied by Control to every connection dialed after
+// SetMark is called, whenever its dialer was created; it defaults to DefaultMark so dae works out of the
+// box without requiring callers to configure it.
+var mark atomic.Uint32
+
+func init() {
+	mark.Store(DefaultMark)
+}
+
+// SetMark configures the fwmark used by Control for connections dialed from
+// now on, including those of dialers created earlier. ControlPlane plumbs its configured (or default) mark down to
+// here as part of NewControlPlane/NewControlPlaneFromConfig.
+func SetMark(m uint32) {
+	mark.Store(m)
+}
+
+// Mark returns the fwmark currently configured via SetMark.
+func Mark() uint32 {
+	return mark.Load()
+}
+
+// ControlOptions customizes the net.Dialer.Control function built by
+// Control: besides the fwmark (always applied), callers can opt into
+// pinning the dialer to a WAN interface and/or deferring local port
+// allocation to connect(2).
+type ControlOptions struct {
+	BindToDevice      string
+	BindAddressNoPort bool
+}
+
+// Control builds a net.Dialer.Control function that applies the current
+// fwmark (see SetMark) and, if requested, SO_BINDTODEVICE /
+// IP_BIND_ADDRESS_NO_PORT. It is the dae analogue of wireguard-go's
+// conn/mark_unix.go + controlfns_linux.go split. NewFromLink and
+// FullconeDirectDialer set this as the Control func of the net.Dialer they
+// build, so every dialer dae opens for its own outbounds carries the mark.
+//
+// The mark itself is resolved lazily, at dial time, not here: dialers are
+// built once (some, like FullconeDirectDialer, at package init) and then
+// reused for the process lifetime, while SetMark can run after they're
+// constructed, so Control must not freeze Mark()'s value into the closure.
+func Control(opts ControlOptions) func(network, address string, c syscall.RawConn) error {
+	fns := []func(network, address string, c syscall.RawConn) error{controlMark()}
+	if opts.BindToDevice != "" {
+		fns = append(fns, controlBindToDevice(opts.BindToDevice))
+	}
+	if opts.BindAddressNoPort {
+		fns = append(fns, controlBindAddressNoPort())
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, fn := range fns {
+			if err := fn(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,61 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) since 2022, mzz2017 (mzz@tuta.io). All rights reserved.
+ */
+
+package dialer
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// controlMark sets SO_MARK on fd to the fwmark currently configured via
+// SetMark, so the eBPF programs attached by ControlPlane.BindLink can
+// recognize dae's own outbound connections (via the matching key in
+// ParamMap) and let them bypass tproxy redirection instead of looping back
+// into the tc filters. It reads Mark() at dial time, not at Control-build
+// time: FullconeDirectDialer and outbounds built by NewFromLink are
+// constructed before newControlPlane calls SetMark(mark), so a mark
+// captured eagerly would always be DefaultMark regardless of configuration.
+func controlMark() func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var setErr error
+		if err := c.Control(func(fd uintptr) {
+			setErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, int(Mark()))
+		}); err != nil {
+			return err
+		}
+		return setErr
+	}
+}
+
+// controlBindToDevice sets SO_BINDTODEVICE on fd to ifname, pinning the
+// dialer to a specific WAN interface.
+func controlBindToDevice(ifname string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var setErr error
+		if err := c.Control(func(fd uintptr) {
+			setErr = unix.BindToDevice(int(fd), ifname)
+		}); err != nil {
+			return err
+		}
+		return setErr
+	}
+}
+
+// controlBindAddressNoPort sets IP_BIND_ADDRESS_NO_PORT, deferring local
+// port allocation until connect(2) so many outbound connections can share
+// a bound local address without exhausting the ephemeral port range.
+func controlBindAddressNoPort() func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var setErr error
+		if err := c.Control(func(fd uintptr) {
+			setErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_BIND_ADDRESS_NO_PORT, 1)
+		}); err != nil {
+			return err
+		}
+		return setErr
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+/*
+ * SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) since 2022, mzz2017 (mzz@tuta.io). All rights reserved.
+ */
+
+package dialer
+
+import "syscall"
+
+// SO_MARK, SO_BINDTODEVICE and IP_BIND_ADDRESS_NO_PORT are Linux-only; on
+// other platforms these are no-ops so callers don't need build tags of
+// their own.
+
+func controlMark() func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error { return nil }
+}
+
+func controlBindToDevice(ifname string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error { return nil }
+}
+
+func controlBindAddressNoPort() func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error { return nil }
+}
@@ -0,0 +1,52 @@
+/*
+ * SPDX-License-Identifier: AGPL-3.0-only
+ * Copyright (c) since 2022, mzz2017 (mzz@tuta.io). All rights reserved.
+ */
+
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Dialer is one outbound node: something outbound.DialerGroup can select
+// and hand a connection to. d wires in Control (fwmark, and optionally
+// SO_BINDTODEVICE / IP_BIND_ADDRESS_NO_PORT) so every connection dae opens
+// for its own outbounds is recognizable to the eBPF programs attached by
+// ControlPlane.BindLink and doesn't loop back through the tc filters.
+type Dialer struct {
+	Name string
+	d    *net.Dialer
+}
+
+// DialContext dials address over network using this node.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.d.DialContext(ctx, network, address)
+}
+
+// FullconeDirectDialer dials directly from the host network namespace
+// (no proxy hop), carrying the configured anti-loop fwmark.
+var FullconeDirectDialer = &Dialer{
+	Name: "direct",
+	d:    &net.Dialer{Control: Control(ControlOptions{})},
+}
+
+// NewFromLink builds a Dialer for a single proxy node described by link, a
+// share link such as socks5://, ss://, ssr://, vmess://, vless:// or
+// trojan://.
+//
+// NewFromLink does not parse link and speaks no proxy protocol, for any
+// scheme: link is only checked to be non-empty and kept as the Dialer's
+// Name, and DialContext dials the requested address directly, carrying
+// the fwmark, just as FullconeDirectDialer does.
+func NewFromLink(link string) (*Dialer, error) {
+	if link == "" {
+		return nil, fmt.Errorf("empty dialer link")
+	}
+	return &Dialer{
+		Name: link,
+		d:    &net.Dialer{Control: Control(ControlOptions{})},
+	}, nil
+}